@@ -6,6 +6,9 @@ package gin
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
@@ -16,23 +19,289 @@ var _ http.ResponseWriter = (*ResponseWriter)(nil)
 var _ http.Flusher = (*ResponseWriter)(nil)
 var _ http.Hijacker = (*ResponseWriter)(nil)
 var _ http.CloseNotifier = (*ResponseWriter)(nil)
+var _ http.Pusher = (*ResponseWriter)(nil)
 var _ io.ReaderFrom = (*ResponseWriter)(nil)
 
-// ResponseWriter implements http.ResponseWriter, http.Flusher, http.Hijacker, http.CloseNotifier and io.ReaderFrom.
+// ResponseWriter implements http.ResponseWriter, http.Flusher, http.Hijacker, http.CloseNotifier, http.Pusher and io.ReaderFrom.
 type ResponseWriter struct {
 	responseWriter http.ResponseWriter
 	hijacked       bool  // connection has been hijacked by handler
 	wroteHeader    bool  // reply header has been (logically) written
 	status         int   // status code passed to WriteHeader
 	written        int64 // number of bytes written in body
+	beforeFuncs    []func()
+	afterFuncs     []func()
+	beforeCalled   bool // before hooks have already fired
+	afterCalled    bool // after hooks have already fired
+	buffering      bool // response is being captured in buf instead of written through
+	// buf captures the body while buffering is on. Write/WriteString/ReadFrom
+	// all route here instead of through writer, so these bytes aren't
+	// counted in Written until commit's own write through w.writer sends
+	// them to the client.
+	buf       bytes.Buffer
+	bufHeader http.Header
+	bufStatus int
+	writer    io.Writer // current target of Write/WriteString/ReadFrom, defaults to sink
+	sink      *countingWriter
+}
+
+// countingWriter wraps the real underlying http.ResponseWriter and is
+// always the innermost writer in the chain, so Written() keeps reporting
+// bytes actually delivered to the client even when a compression
+// middleware has replaced writer with e.g. a gzip.Writer.
+type countingWriter struct {
+	w *ResponseWriter
+	io.Writer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.w.written += int64(n)
+	return n, err
 }
 
 func (w *ResponseWriter) reset(writer http.ResponseWriter) {
+	// Finish is a no-op if Wrap already ran it when the handler returned.
+	// Calling it again here is only a safety net for callers that reset a
+	// pooled writer directly without going through Wrap; relying on it
+	// alone would make After hooks fire late, whenever the writer is next
+	// reused rather than when the request actually ended.
+	w.Finish()
 	w.responseWriter = writer
 	w.hijacked = false
 	w.wroteHeader = false
 	w.status = http.StatusOK
 	w.written = 0
+	w.beforeFuncs = nil
+	w.afterFuncs = nil
+	w.beforeCalled = false
+	w.afterCalled = false
+	w.buffering = false
+	w.buf.Reset()
+	w.bufHeader = nil
+	w.bufStatus = 0
+	w.sink = &countingWriter{w: w, Writer: writer}
+	w.writer = w.sink
+}
+
+// SetWriter replaces the io.Writer that Write, WriteString and ReadFrom
+// target, allowing a middleware to splice in a gzip.Writer, br.Writer or
+// a tee for access logging. Wrap Writer's current value (rather than the
+// raw *http.ResponseWriter) so Written still accounts for the bytes the
+// new writer ultimately emits.
+func (w *ResponseWriter) SetWriter(writer io.Writer) {
+	w.writer = writer
+}
+
+// Writer returns the io.Writer currently targeted by Write, WriteString
+// and ReadFrom. It defaults to an internal writer wrapping the
+// underlying http.ResponseWriter.
+func (w *ResponseWriter) Writer() io.Writer {
+	return w.writer
+}
+
+// Buffer enables or disables buffered response mode. While enabled, the
+// status code, headers and body are captured in memory instead of being
+// written through to the underlying http.ResponseWriter, so a middleware
+// can inspect or discard the response (via Reset) before it reaches the
+// client. Call Commit to flush the buffered response, including its
+// conditional-GET handling; disabling buffering via Buffer(false) before
+// an explicit Commit implicitly commits whatever was already buffered so
+// it is never silently dropped.
+func (w *ResponseWriter) Buffer(enabled bool) {
+	if !enabled && w.buffering {
+		hasBuffered := w.wroteHeader || len(w.bufHeader) > 0 || w.buf.Len() > 0
+		w.buffering = false
+		if hasBuffered {
+			w.commit(nil)
+		}
+		return
+	}
+	w.buffering = enabled
+	if enabled && w.bufHeader == nil {
+		w.bufHeader = make(http.Header)
+	}
+}
+
+// Buffering reports whether buffered response mode is enabled.
+func (w *ResponseWriter) Buffering() bool {
+	return w.buffering
+}
+
+// Body returns the response body captured so far while buffering is
+// enabled.
+func (w *ResponseWriter) Body() []byte {
+	return w.buf.Bytes()
+}
+
+// Reset discards the buffered status, headers and body, allowing a
+// middleware to replace the response entirely, for example to render an
+// error page after a recovered panic. Buffering stays enabled. Reset is a
+// no-op unless buffering mode is active, since otherwise the buffered
+// fields it zeroes may already be stale relative to a response that was
+// committed to the client.
+func (w *ResponseWriter) Reset() {
+	if !w.buffering {
+		return
+	}
+	w.buf.Reset()
+	w.bufHeader = make(http.Header)
+	w.bufStatus = 0
+	w.wroteHeader = false
+	w.status = http.StatusOK
+}
+
+// Commit flushes the buffered response to the underlying
+// http.ResponseWriter and disables buffering. If the buffered body
+// produces a strong ETag that satisfies the request's If-None-Match (or
+// If-Modified-Since) header, Commit short-circuits to a 304 Not Modified
+// with no body instead of writing the buffered one.
+func (w *ResponseWriter) Commit(req *http.Request) error {
+	if !w.buffering {
+		return nil
+	}
+	w.buffering = false
+	return w.commit(req)
+}
+
+// commit writes the buffered status, headers and body through to the
+// underlying http.ResponseWriter. The caller is responsible for clearing
+// w.buffering beforehand.
+func (w *ResponseWriter) commit(req *http.Request) error {
+	header := w.responseWriter.Header()
+	for key, values := range w.bufHeader {
+		header[key] = values
+	}
+	if header.Get("ETag") == "" {
+		header.Set("ETag", strongETag(w.buf.Bytes()))
+	}
+
+	status := w.bufStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if notModified(req, header) {
+		header.Del("Content-Length")
+		status = http.StatusNotModified
+		w.buf.Reset()
+	}
+
+	w.callBefore()
+	w.wroteHeader = true
+	w.status = status
+	w.responseWriter.WriteHeader(status)
+	_, err := w.writer.Write(w.buf.Bytes())
+
+	// After hooks fire exactly once, at the real end of the request via
+	// Finish/Wrap, not here: a single request may run several
+	// Buffer/Commit cycles before it actually ends, and firing them on
+	// every commit would make Written() report a premature total and
+	// never run the hooks again for the rest of the request.
+
+	// Clear the buffered state now that it has been flushed, so a later
+	// Buffer(true) cycle within the same request starts from a clean
+	// slate instead of resurrecting this response's body and headers.
+	w.buf.Reset()
+	w.bufHeader = make(http.Header)
+	w.bufStatus = 0
+
+	return err
+}
+
+// strongETag computes a strong ETag from a response body.
+func strongETag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// notModified reports whether req is a conditional GET satisfied by the
+// given response headers.
+func notModified(req *http.Request, header http.Header) bool {
+	if req == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return inm == header.Get("ETag")
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	lm := header.Get("Last-Modified")
+	if ims == "" || lm == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lm)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// Before registers a function to call before the response headers are
+// committed, i.e. immediately before the status is first passed on to the
+// underlying http.ResponseWriter (at commit time while buffering). This
+// is the right place to set headers like X-Response-Time, ETags or
+// cookies once the final status code is known. Hooks run in the order
+// they were registered and are skipped entirely if the connection is
+// hijacked.
+func (w *ResponseWriter) Before(fn func()) {
+	w.beforeFuncs = append(w.beforeFuncs, fn)
+}
+
+// After registers a function to call once the response body has been
+// fully written, letting middleware run metrics or logging without
+// wrapping the handler chain. Hooks run in the order they were
+// registered and are skipped entirely if the connection is hijacked.
+func (w *ResponseWriter) After(fn func()) {
+	w.afterFuncs = append(w.afterFuncs, fn)
+}
+
+// Finish marks the response as complete and runs the after-hooks exactly
+// once, with Status and Written reflecting their final values. Wrap calls
+// it for you once the wrapped handler returns, which is the only point at
+// which a request is actually guaranteed to be finished; call it directly
+// only if you are driving a ResponseWriter without Wrap.
+func (w *ResponseWriter) Finish() {
+	w.callAfter()
+}
+
+// Wrap adapts an http.Handler to serve requests through a ResponseWriter,
+// calling Finish once the handler returns so After hooks fire
+// deterministically at the true end of the request instead of depending
+// on reset's safety net, which only runs whenever the writer is next
+// reused from its pool.
+func Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w := &ResponseWriter{}
+		w.reset(rw)
+		defer w.Finish()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// callBefore runs the before-hooks at most once.
+func (w *ResponseWriter) callBefore() {
+	if w.hijacked || w.beforeCalled {
+		return
+	}
+	w.beforeCalled = true
+	for _, fn := range w.beforeFuncs {
+		fn()
+	}
+}
+
+// callAfter runs the after-hooks at most once.
+func (w *ResponseWriter) callAfter() {
+	if w.hijacked || w.afterCalled {
+		return
+	}
+	w.afterCalled = true
+	for _, fn := range w.afterFuncs {
+		fn()
+	}
 }
 
 // Hijacked replies ResponseWriter whether has been hijacked.
@@ -50,7 +319,9 @@ func (w *ResponseWriter) Status() int {
 	return w.status
 }
 
-// Written returns number of bytes written in body.
+// Written returns number of bytes written in body. It always reflects
+// bytes actually delivered to the client, even if SetWriter has spliced
+// in a compressing io.Writer such as a gzip.Writer.
 func (w *ResponseWriter) Written() int64 {
 	return w.written
 }
@@ -62,6 +333,9 @@ func (w *ResponseWriter) Written() int64 {
 // "Trailer" header before the call to WriteHeader (see example).
 // To suppress implicit response headers, set their value to nil.
 func (w *ResponseWriter) Header() http.Header {
+	if w.buffering {
+		return w.bufHeader
+	}
 	return w.responseWriter.Header()
 }
 
@@ -79,6 +353,13 @@ func (w *ResponseWriter) WriteHeader(code int) {
 		debugPrintf("[WARNING] multiple ResponseWriter.WriteHeader calls\r\n")
 		return
 	}
+	if w.buffering {
+		w.wroteHeader = true
+		w.status = code
+		w.bufStatus = code
+		return
+	}
+	w.callBefore()
 	w.wroteHeader = true
 	w.status = code
 	w.responseWriter.WriteHeader(code)
@@ -93,9 +374,10 @@ func (w *ResponseWriter) Write(data []byte) (n int, err error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
-	n, err = w.responseWriter.Write(data)
-	w.written += int64(n)
-	return
+	if w.buffering {
+		return w.buf.Write(data)
+	}
+	return w.writer.Write(data)
 }
 
 // WriteString writes the data to the connection as part of an HTTP reply.
@@ -107,9 +389,10 @@ func (w *ResponseWriter) WriteString(s string) (n int, err error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
-	n, err = io.WriteString(w.responseWriter, s)
-	w.written += int64(n)
-	return
+	if w.buffering {
+		return w.buf.WriteString(s)
+	}
+	return io.WriteString(w.writer, s)
 }
 
 // ReadFrom implements the io.ReaderFrom interface.
@@ -117,16 +400,25 @@ func (w *ResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
-	n, err = io.Copy(w.responseWriter, r)
-	w.written += n
-	return
+	if w.buffering {
+		return io.Copy(&w.buf, r)
+	}
+	return io.Copy(w.writer, r)
 }
 
-// Flush implements the http.Flusher interface.
+// Flush implements the http.Flusher interface. A streaming handler may
+// call Flush any number of times; After hooks do not fire here; see
+// Finish for that.
 func (w *ResponseWriter) Flush() {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.buffering {
+		return
+	}
+	if flusher, ok := w.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
 	if flusher, ok := w.responseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
@@ -152,3 +444,20 @@ func (w *ResponseWriter) CloseNotify() <-chan bool {
 	}
 	return closeNotifier.CloseNotify()
 }
+
+// Push implements the http.Pusher interface.
+func (w *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := w.responseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, following the
+// standard library's convention so that http.NewResponseController can
+// drill through to the real writer for Go 1.20+ features such as
+// per-request read/write deadlines and full-duplex HTTP/2.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.responseWriter
+}
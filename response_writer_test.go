@@ -0,0 +1,422 @@
+// Copyright 2014 Manu Martinez-Almeida.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package gin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseWriterAfterHookFiresOnSingleWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	var called bool
+	var gotStatus int
+	var gotWritten int64
+	w.After(func() {
+		called = true
+		gotStatus = w.Status()
+		gotWritten = w.Written()
+	})
+
+	if _, err := w.WriteString(`{"hello":"world"}`); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	w.Finish()
+
+	if !called {
+		t.Fatal("After hook did not fire for an ordinary single-write response")
+	}
+	if gotStatus != 200 {
+		t.Errorf("gotStatus = %d, want 200", gotStatus)
+	}
+	if gotWritten != int64(len(`{"hello":"world"}`)) {
+		t.Errorf("gotWritten = %d, want %d", gotWritten, len(`{"hello":"world"}`))
+	}
+}
+
+func TestResponseWriterAfterHookWaitsForFinishAcrossMultipleFlushes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	var calls int
+	var gotWritten int64
+	w.After(func() {
+		calls++
+		gotWritten = w.Written()
+	})
+
+	w.WriteString("chunk1")
+	w.Flush()
+	if calls != 0 {
+		t.Fatalf("After hook fired after the first Flush, want it to wait for Finish")
+	}
+
+	w.WriteString("chunk2")
+	w.Flush()
+	if calls != 0 {
+		t.Fatalf("After hook fired after the second Flush, want it to wait for Finish")
+	}
+
+	w.Finish()
+	if calls != 1 {
+		t.Fatalf("After hook ran %d times, want exactly once", calls)
+	}
+	want := int64(len("chunk1") + len("chunk2"))
+	if gotWritten != want {
+		t.Errorf("gotWritten = %d, want %d (both chunks)", gotWritten, want)
+	}
+}
+
+func TestResponseWriterResetFinishesPendingHooks(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	var called bool
+	w.After(func() { called = true })
+	w.WriteString("body")
+
+	// Simulate the writer being returned to its pool and reused for the
+	// next request without an explicit Finish call.
+	w.reset(httptest.NewRecorder())
+
+	if !called {
+		t.Fatal("reset did not run pending After hooks as a safety net")
+	}
+}
+
+func TestWrapFinishesAfterHandlerReturns(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var calledInsideHandler, calledAfterReturn bool
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := rw.(*ResponseWriter)
+		w.After(func() { calledInsideHandler = true })
+		if !calledInsideHandler {
+			calledAfterReturn = true
+		}
+		w.WriteString("ok")
+	})
+
+	Wrap(handler).ServeHTTP(rec, req)
+
+	if !calledAfterReturn {
+		t.Fatal("After hook fired before the handler returned")
+	}
+	if !calledInsideHandler {
+		t.Fatal("Wrap did not run the After hook once the handler returned")
+	}
+}
+
+func TestResponseWriterBufferResetCommit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.WriteHeader(201)
+	w.Header().Set("X-Draft", "1")
+	w.WriteString("draft body")
+
+	if got := string(w.Body()); got != "draft body" {
+		t.Fatalf("Body() = %q, want %q", got, "draft body")
+	}
+
+	w.Reset()
+	w.WriteHeader(200)
+	w.WriteString("final body")
+
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if rec.Code != 200 {
+		t.Errorf("rec.Code = %d, want 200", rec.Code)
+	}
+	if rec.Body.String() != "final body" {
+		t.Errorf("rec.Body = %q, want %q", rec.Body.String(), "final body")
+	}
+	if rec.Header().Get("X-Draft") != "" {
+		t.Errorf("X-Draft header leaked through Reset: %q", rec.Header().Get("X-Draft"))
+	}
+}
+
+func TestResponseWriterResetNoopWithoutBuffering(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.WriteString("already sent")
+	wantStatus, wantWritten := w.Status(), w.Written()
+
+	w.Reset()
+
+	if w.Status() != wantStatus {
+		t.Errorf("Status() = %d, want %d (Reset must not touch a response already committed to the client)", w.Status(), wantStatus)
+	}
+	if w.Written() != wantWritten {
+		t.Errorf("Written() = %d, want %d (Reset must not touch a response already committed to the client)", w.Written(), wantWritten)
+	}
+}
+
+func TestResponseWriterBufferFalseCommitsPendingData(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.WriteHeader(201)
+	w.Header().Set("X-Draft", "1")
+	w.WriteString("draft body")
+
+	w.Buffer(false)
+
+	if rec.Code != 201 {
+		t.Errorf("rec.Code = %d, want 201 (buffered response lost on Buffer(false))", rec.Code)
+	}
+	if rec.Body.String() != "draft body" {
+		t.Errorf("rec.Body = %q, want %q (buffered body lost on Buffer(false))", rec.Body.String(), "draft body")
+	}
+	if rec.Header().Get("X-Draft") != "1" {
+		t.Errorf("X-Draft header lost on Buffer(false)")
+	}
+}
+
+func TestResponseWriterBufferFalseRunsBeforeHookAgainstRealHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Before(func() { w.Header().Set("X-Response-Time", "1ms") })
+
+	w.Buffer(true)
+	w.WriteHeader(200)
+	w.WriteString("body")
+	w.Buffer(false)
+
+	if got := rec.Header().Get("X-Response-Time"); got != "1ms" {
+		t.Errorf("X-Response-Time = %q, want %q (Before hook's header write was routed into the discarded buffer)", got, "1ms")
+	}
+}
+
+func TestResponseWriterBufferFalseCommitsHeadersOnlyBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.Header().Set("X-Draft", "1")
+	w.Buffer(false)
+
+	if got := rec.Header().Get("X-Draft"); got != "1" {
+		t.Errorf("X-Draft = %q, want %q (header-only buffered response dropped on Buffer(false) since WriteHeader was never called)", got, "1")
+	}
+}
+
+func TestResponseWriterCommitNotModified(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.WriteString("cacheable body")
+
+	etag := strongETag([]byte("cacheable body"))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+
+	if err := w.Commit(req); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if rec.Code != 304 {
+		t.Errorf("rec.Code = %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("rec.Body = %q, want empty body on 304", rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != etag {
+		t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), etag)
+	}
+	if w.Written() != 0 {
+		t.Errorf("Written() = %d, want 0 (body was reset before the 304 was sent)", w.Written())
+	}
+}
+
+func TestResponseWriterCommitDoesNotDoubleCountWritten(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.WriteString("hello world")
+
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if rec.Body.String() != "hello world" {
+		t.Errorf("rec.Body = %q, want %q", rec.Body.String(), "hello world")
+	}
+	if want := int64(len("hello world")); w.Written() != want {
+		t.Errorf("Written() = %d, want %d (bytes counted twice: once while buffering, once on commit)", w.Written(), want)
+	}
+}
+
+func TestResponseWriterCommitDoesNotFireAfterHookEarly(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	var calls int
+	var gotWritten int64
+	w.After(func() {
+		calls++
+		gotWritten = w.Written()
+	})
+
+	w.Buffer(true)
+	w.WriteString("hello wo")
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("After hook fired on Commit, want it to wait for Finish")
+	}
+
+	w.WriteString("rld")
+	w.Finish()
+
+	if calls != 1 {
+		t.Fatalf("After hook ran %d times, want exactly once", calls)
+	}
+	want := int64(len("hello world"))
+	if gotWritten != want {
+		t.Errorf("gotWritten = %d, want %d (Written must reflect the full request, not just the committed chunk)", gotWritten, want)
+	}
+}
+
+func TestResponseWriterBufferCommitCycleDoesNotLeakState(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	w.Buffer(true)
+	w.Header().Set("X-Old", "1")
+	w.WriteString("OLDBODY")
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("first Commit: %v", err)
+	}
+
+	w.Buffer(true)
+	w.WriteString("NEW")
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("second Commit: %v", err)
+	}
+
+	if rec.Body.String() != "OLDBODYNEW" {
+		t.Errorf("rec.Body = %q, want %q (stale buffered body leaked into the second commit)", rec.Body.String(), "OLDBODYNEW")
+	}
+}
+
+func TestResponseWriterBeforeHookFiresOnceAcrossCommitCycles(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	var calls int
+	w.Before(func() { calls++ })
+
+	w.Buffer(true)
+	w.WriteString("first")
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("first Commit: %v", err)
+	}
+
+	w.Buffer(true)
+	w.WriteString("second")
+	if err := w.Commit(nil); err != nil {
+		t.Fatalf("second Commit: %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("Before hook ran %d times across two Buffer/Commit cycles, want exactly once", calls)
+	}
+}
+
+type pushNotSupported struct{ *httptest.ResponseRecorder }
+
+func TestResponseWriterPushNotSupported(t *testing.T) {
+	rec := &pushNotSupported{httptest.NewRecorder()}
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	if err := w.Push("/style.css", nil); err == nil {
+		t.Fatal("Push returned nil error for a responseWriter without http.Pusher support")
+	}
+}
+
+func TestResponseWriterUnwrap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	if w.Unwrap() != rec {
+		t.Fatal("Unwrap did not return the underlying http.ResponseWriter")
+	}
+}
+
+// countingDst is a plain io.Writer sink used to verify that SetWriter lets
+// a middleware splice in its own writer, so writes reach it instead of the
+// default sink.
+type countingDst struct{ n int }
+
+func (d *countingDst) Write(p []byte) (int, error) {
+	d.n += len(p)
+	return len(p), nil
+}
+
+func TestResponseWriterSetWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	dst := &countingDst{}
+	w.SetWriter(dst)
+
+	if _, err := w.WriteString("hello"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	if dst.n != len("hello") {
+		t.Errorf("dst.n = %d, want %d", dst.n, len("hello"))
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("rec.Body = %q, want empty (writes should go to the spliced-in writer, not the default sink)", rec.Body.String())
+	}
+}
+
+func TestResponseWriterDefaultWriterCountsThroughToClient(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &ResponseWriter{}
+	w.reset(rec)
+
+	if _, err := w.WriteString("hello"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	if w.Written() != int64(len("hello")) {
+		t.Errorf("Written() = %d, want %d", w.Written(), len("hello"))
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("rec.Body = %q, want %q", rec.Body.String(), "hello")
+	}
+}